@@ -0,0 +1,277 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	eventsapi "github.com/containerd/containerd/api/services/events/v1"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// containerdDefaultNamespace is the namespace docker-gc operates in when
+// talking to containerd directly. It matches the namespace dockerd itself
+// uses when backed by containerd, so the same images/containers are seen.
+const containerdDefaultNamespace = "moby"
+
+// containerdRuntime implements Runtime against a containerd socket, for
+// nodes (e.g. Kubernetes workers) that no longer run dockerd.
+type containerdRuntime struct {
+	client *containerd.Client
+}
+
+func newContainerdRuntime(address string) (Runtime, error) {
+	if address == "" {
+		address = "/run/containerd/containerd.sock"
+	}
+	c, err := containerd.New(address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to containerd at %s: %w", address, err)
+	}
+	return &containerdRuntime{client: c}, nil
+}
+
+func (r *containerdRuntime) withNamespace(ctx context.Context) context.Context {
+	return namespaces.WithNamespace(ctx, containerdDefaultNamespace)
+}
+
+// ImageList uses the image Name as the summary ID rather than the manifest
+// digest: the containerd ImageService's Get/Delete key on Name, so List,
+// ImageInspectWithRaw and ImageRemove must agree on that same key for prune
+// to be able to look an image back up and actually delete it.
+// Every image here is keyed by a name and none is treated as dangling, so a
+// dangling=true listing is empty.
+func (r *containerdRuntime) ImageList(ctx context.Context, filterArgs filters.Args) ([]types.ImageSummary, error) {
+	if filterArgs.ExactMatch("dangling", "true") {
+		return []types.ImageSummary{}, nil
+	}
+	images, err := r.client.ListImages(r.withNamespace(ctx))
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]types.ImageSummary, 0, len(images))
+	for _, img := range images {
+		summaries = append(summaries, types.ImageSummary{
+			ID:       img.Name(),
+			RepoTags: []string{img.Name()},
+			Size:     img.Target().Size,
+			Created:  img.Metadata().CreatedAt.Unix(),
+		})
+	}
+	return summaries, nil
+}
+
+func (r *containerdRuntime) ImageInspectWithRaw(ctx context.Context, id string) (types.ImageInspect, error) {
+	nsCtx := r.withNamespace(ctx)
+	img, err := r.client.GetImage(nsCtx, id)
+	if err != nil {
+		return types.ImageInspect{}, err
+	}
+	labels, err := r.imageConfigLabels(nsCtx, img)
+	if err != nil {
+		log.WithError(err).WithField("image", id).Warn("Cannot read image config, label filters will not match")
+	}
+	return types.ImageInspect{
+		ID:      img.Name(),
+		Created: img.Metadata().CreatedAt.Format(time.RFC3339),
+		Config:  &container.Config{Labels: labels},
+	}, nil
+}
+
+// imageConfigLabels reads and decodes img's OCI config to recover the labels
+// baked into the image, mirroring what the Docker backend gets for free from
+// ImageInspectWithRaw so matchesLabelFilters behaves the same on either
+// runtime.
+func (r *containerdRuntime) imageConfigLabels(ctx context.Context, img containerd.Image) (map[string]string, error) {
+	desc, err := img.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := content.ReadBlob(ctx, img.ContentStore(), desc)
+	if err != nil {
+		return nil, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(blob, &config); err != nil {
+		return nil, err
+	}
+	return config.Config.Labels, nil
+}
+
+func (r *containerdRuntime) ImageRemove(ctx context.Context, id string) ([]types.ImageDeleteResponseItem, error) {
+	if err := r.client.ImageService().Delete(r.withNamespace(ctx), id); err != nil {
+		return nil, err
+	}
+	return []types.ImageDeleteResponseItem{{Deleted: id}}, nil
+}
+
+func (r *containerdRuntime) ContainerList(ctx context.Context, all bool) ([]types.Container, error) {
+	nsCtx := r.withNamespace(ctx)
+	containers, err := r.client.Containers(nsCtx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]types.Container, 0, len(containers))
+	for _, c := range containers {
+		info, err := c.Info(nsCtx)
+		if err != nil {
+			log.WithError(err).WithField("id", c.ID()).Warn("Cannot read containerd container info")
+			continue
+		}
+		result = append(result, types.Container{
+			ID:     c.ID(),
+			Image:  info.Image,
+			Status: r.containerStatus(nsCtx, c),
+		})
+	}
+	return result, nil
+}
+
+// containerStatus reports a Docker-style "Exited"/"Up" status string so
+// loadImageDataFromDocker's strings.HasPrefix(status, "Exit") check, written
+// against the Docker backend's Container.Status strings, also fires here.
+func (r *containerdRuntime) containerStatus(ctx context.Context, c containerd.Container) string {
+	task, err := c.Task(ctx, nil)
+	if err != nil {
+		return "Exited"
+	}
+	status, err := task.Status(ctx)
+	if err != nil || status.Status == containerd.Stopped {
+		return "Exited"
+	}
+	return "Up"
+}
+
+func (r *containerdRuntime) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	c, err := r.client.LoadContainer(r.withNamespace(ctx), id)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	task, err := c.Task(r.withNamespace(ctx), nil)
+	if err != nil {
+		// No task means the container never ran, or already exited and was
+		// reaped; treat it as exited "now" so age-based callers don't stall.
+		return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+			State: &types.ContainerState{FinishedAt: time.Now().Format(time.RFC3339)},
+		}}, nil
+	}
+	status, err := task.Status(r.withNamespace(ctx))
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	finishedAt := ""
+	if status.Status == containerd.Stopped {
+		finishedAt = status.ExitTime.Format(time.RFC3339)
+	}
+	return types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{
+		State: &types.ContainerState{FinishedAt: finishedAt},
+	}}, nil
+}
+
+func (r *containerdRuntime) Events(ctx context.Context) (<-chan events.Message, <-chan error) {
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	nsCtx := r.withNamespace(ctx)
+	envelopes, cdErrs := r.client.Subscribe(nsCtx)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-cdErrs:
+				errs <- err
+				return
+			case env := <-envelopes:
+				msg, ok := r.translateEnvelope(nsCtx, env)
+				if !ok {
+					continue
+				}
+				msgs <- msg
+			}
+		}
+	}()
+	return msgs, errs
+}
+
+// translateEnvelope maps a containerd event envelope to the docker
+// events.Message shape that handleEvent/handleContainerEvent/handleImageEvent
+// expect, so event-driven tracking behaves the same under both backends.
+// Envelopes docker-gc has no use for (e.g. snapshot or content events) are
+// reported as not ok so the caller skips them.
+func (r *containerdRuntime) translateEnvelope(ctx context.Context, env *eventsapi.Envelope) (events.Message, bool) {
+	payload, err := typeurl.UnmarshalAny(env.Event)
+	if err != nil {
+		log.WithError(err).WithField("topic", env.Topic).Warn("Cannot unmarshal containerd event")
+		return events.Message{}, false
+	}
+
+	msg := events.Message{Time: env.Timestamp.Unix()}
+	switch v := payload.(type) {
+	case *apievents.TaskStart:
+		msg.Type = events.ContainerEventType
+		msg.Action = "start"
+		msg.Actor.ID = v.ContainerID
+		msg.Actor.Attributes = map[string]string{"image": r.containerImage(ctx, v.ContainerID)}
+	case *apievents.TaskExit:
+		msg.Type = events.ContainerEventType
+		msg.Action = "die"
+		msg.Actor.ID = v.ContainerID
+		msg.Actor.Attributes = map[string]string{"image": r.containerImage(ctx, v.ContainerID)}
+	case *apievents.TaskDelete:
+		msg.Type = events.ContainerEventType
+		msg.Action = "destroy"
+		msg.Actor.ID = v.ContainerID
+		msg.Actor.Attributes = map[string]string{"image": r.containerImage(ctx, v.ContainerID)}
+	case *apievents.ImageCreate:
+		msg.Type = events.ImageEventType
+		msg.Action = "pull"
+		msg.Actor.ID = v.Name
+	case *apievents.ImageUpdate:
+		msg.Type = events.ImageEventType
+		msg.Action = "tag"
+		msg.Actor.ID = v.Name
+	default:
+		return events.Message{}, false
+	}
+	return msg, true
+}
+
+// containerImage best-effort resolves the image reference a container was
+// created from, so container task events carry the same
+// Actor.Attributes["image"] the Docker backend's events do.
+func (r *containerdRuntime) containerImage(ctx context.Context, id string) string {
+	c, err := r.client.LoadContainer(ctx, id)
+	if err != nil {
+		return ""
+	}
+	info, err := c.Info(ctx)
+	if err != nil {
+		return ""
+	}
+	return info.Image
+}
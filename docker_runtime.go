@@ -0,0 +1,76 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// dockerRuntime implements Runtime against a Docker Engine client.
+type dockerRuntime struct {
+	cli dockerClient
+}
+
+// dockerClient is the subset of *client.Client used by dockerRuntime.
+type dockerClient interface {
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+	ImageInspectWithRaw(ctx context.Context, id string) (types.ImageInspect, []byte, error)
+	ImageRemove(ctx context.Context, id string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+func newDockerRuntime() (Runtime, error) {
+	return &dockerRuntime{cli: cli}, nil
+}
+
+func (d *dockerRuntime) ImageList(ctx context.Context, filterArgs filters.Args) ([]types.ImageSummary, error) {
+	return d.cli.ImageList(ctx, types.ImageListOptions{Filters: filterArgs})
+}
+
+func (d *dockerRuntime) ImageInspectWithRaw(ctx context.Context, id string) (types.ImageInspect, error) {
+	inspect, _, err := d.cli.ImageInspectWithRaw(ctx, id)
+	return inspect, err
+}
+
+func (d *dockerRuntime) ImageRemove(ctx context.Context, id string) ([]types.ImageDeleteResponseItem, error) {
+	return d.cli.ImageRemove(ctx, id, types.ImageRemoveOptions{})
+}
+
+func (d *dockerRuntime) ContainerList(ctx context.Context, all bool) ([]types.Container, error) {
+	return d.cli.ContainerList(ctx, types.ContainerListOptions{All: all})
+}
+
+func (d *dockerRuntime) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	return d.cli.ContainerInspect(ctx, id)
+}
+
+func (d *dockerRuntime) Events(ctx context.Context) (<-chan events.Message, <-chan error) {
+	eventFilters := filters.NewArgs()
+	eventFilters.Add("type", string(events.ContainerEventType))
+	eventFilters.Add("type", string(events.ImageEventType))
+	eventFilters.Add("event", "start")
+	eventFilters.Add("event", "die")
+	eventFilters.Add("event", "destroy")
+	eventFilters.Add("event", "exec_start")
+	eventFilters.Add("event", "pull")
+	eventFilters.Add("event", "tag")
+	return d.cli.Events(ctx, types.EventsOptions{Filters: eventFilters})
+}
@@ -0,0 +1,134 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"github.com/docker/docker/api/types/events"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// watchEvents subscribes to the runtime's events stream and keeps lastUse
+// up to date in near-real-time, reconnecting with backoff when the stream
+// drops. The periodic Prune ticker in main() remains as a safety net.
+func watchEvents(ctx context.Context) {
+	backoff := time.Second
+	for {
+		err := consumeEvents(ctx, &backoff)
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithError(err).WithField("retryIn", backoff).Warn("Docker events stream interrupted, reconnecting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+		log.Info("Resyncing image usage from containers after events reconnect")
+		loadImageDataFromDocker()
+	}
+}
+
+// consumeEvents reads the events stream until it errors out or ctx is done.
+// backoff is reset to its initial value as soon as a message is received,
+// so a long-lived connection doesn't inherit a stale retry delay.
+func consumeEvents(ctx context.Context, backoff *time.Duration) error {
+	messages, errs := rt.Events(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case msg := <-messages:
+			*backoff = time.Second
+			handleEvent(msg)
+		}
+	}
+}
+
+func handleEvent(msg events.Message) {
+	switch msg.Type {
+	case events.ContainerEventType:
+		handleContainerEvent(msg)
+	case events.ImageEventType:
+		handleImageEvent(msg)
+	}
+}
+
+func handleContainerEvent(msg events.Message) {
+	switch {
+	case msg.Action == "start", strings.HasPrefix(msg.Action, "exec_start"):
+		if id := eventImageID(msg); id != "" {
+			log.WithFields(log.Fields{"image": id, "container": msg.Actor.ID}).Debug("Image used by event")
+			updateImageLastUsage(id, time.Now())
+		}
+	case msg.Action == "die", msg.Action == "destroy":
+		id := eventImageID(msg)
+		if id == "" {
+			return
+		}
+		usage := time.Unix(msg.Time, 0)
+		if old, ok := lastUseGet(id); !ok || old.Before(usage) {
+			updateImageLastUsage(id, usage)
+		}
+	}
+}
+
+func handleImageEvent(msg events.Message) {
+	switch msg.Action {
+	case "pull", "tag":
+		id := resolveImageID(msg.Actor.ID)
+		if id == "" {
+			return
+		}
+		if _, tracked := lastUseGet(id); !tracked {
+			log.WithField("image", id).Debug("Seeding last use for freshly pulled/tagged image")
+			updateImageLastUsage(id, time.Now())
+		}
+	}
+}
+
+// eventImageID resolves the image ID referenced by a container event, since
+// the event only carries the image name/tag the container was created from.
+func eventImageID(msg events.Message) string {
+	image, ok := msg.Actor.Attributes["image"]
+	if !ok {
+		return ""
+	}
+	return resolveImageID(image)
+}
+
+// resolveImageID inspects image, a name/tag/digest reference, and returns the
+// ID the runtime reports for it (the sha256 ID under Docker, the image name
+// under containerd), so callers always key lastUse the same way regardless of
+// which reference an event happened to carry.
+func resolveImageID(image string) string {
+	if image == "" {
+		return ""
+	}
+	inspect, err := rt.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		log.WithError(err).WithField("image", image).Warn("Cannot inspect image for event")
+		return ""
+	}
+	return inspect.ID
+}
@@ -25,38 +25,148 @@ import (
 	log "github.com/sirupsen/logrus"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	cli            *client.Client
+	rt             Runtime
 	db             *bolt.DB
 	dbPath         = flag.String("db", "/var/db/docker-gc/state.db", "Location of the database file")
 	debug          = flag.Bool("debug", false, "Enable debug output")
 	maxAge         = flag.Duration("maxAge", 72*time.Hour, "max duration for an unused image")
+	lastUseMu      sync.Mutex
 	lastUse        = map[string]time.Time{}
 	purgeFrequency = flag.Duration("purgeFrequency", 57*time.Second, "How often the image purge will be run")
+	keep           keepFlag
+	keepMinCount   = flag.Int("keepMinCount", 0, "Always keep at least N most recently created tags per repository")
 )
 
+func init() {
+	flag.Var(&keep, "keep", "Regex matched against image RepoTags to protect from removal (repeatable)")
+}
+
+// keepFlag collects one or more -keep regex patterns into a flag.Value.
+type keepFlag []*regexp.Regexp
+
+func (k *keepFlag) String() string {
+	patterns := make([]string, len(*k))
+	for i, re := range *k {
+		patterns[i] = re.String()
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (k *keepFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*k = append(*k, re)
+	return nil
+}
+
+// isKept reports whether any of the image's RepoTags matches a -keep pattern.
+func isKept(repoTags []string) bool {
+	for _, tag := range repoTags {
+		for _, re := range keep {
+			if re.MatchString(tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keepMinCountIDs returns the set of image IDs protected by -keepMinCount,
+// i.e. the images behind the N most recently created tags of each
+// repository. An image with several tags in one repository fills several of
+// those N slots.
+func keepMinCountIDs(images []types.ImageSummary, n int) map[string]bool {
+	protected := map[string]bool{}
+	if n <= 0 {
+		return protected
+	}
+	byRepo := map[string][]types.ImageSummary{}
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			repo := tag
+			if i := strings.LastIndex(tag, ":"); i >= 0 {
+				repo = tag[:i]
+			}
+			byRepo[repo] = append(byRepo[repo], image)
+		}
+	}
+	for _, repoImages := range byRepo {
+		sort.Slice(repoImages, func(i, j int) bool {
+			return repoImages[i].Created > repoImages[j].Created
+		})
+		for i := 0; i < len(repoImages) && i < n; i++ {
+			protected[repoImages[i].ID] = true
+		}
+	}
+	return protected
+}
+
 const (
 	BUCKET_IMAGE = "images"
 )
 
-func init() {
-	c, err := client.NewEnvClient()
-	if err != nil {
-		log.Fatal("Failed to setup docker client " + err.Error())
+// lastUse is read and written from the main ticker loop, the events watcher
+// goroutine, and HTTP control-plane handlers, so all access once those are
+// running goes through these helpers rather than the map directly.
+
+func lastUseGet(id string) (time.Time, bool) {
+	lastUseMu.Lock()
+	defer lastUseMu.Unlock()
+	usage, ok := lastUse[id]
+	return usage, ok
+}
+
+func lastUseSet(id string, usage time.Time) {
+	lastUseMu.Lock()
+	lastUse[id] = usage
+	metricTrackedImages.Set(float64(len(lastUse)))
+	lastUseMu.Unlock()
+}
+
+func lastUseDelete(id string) {
+	lastUseMu.Lock()
+	delete(lastUse, id)
+	metricTrackedImages.Set(float64(len(lastUse)))
+	lastUseMu.Unlock()
+}
+
+func lastUseSnapshot() map[string]time.Time {
+	lastUseMu.Lock()
+	defer lastUseMu.Unlock()
+	snapshot := make(map[string]time.Time, len(lastUse))
+	for id, usage := range lastUse {
+		snapshot[id] = usage
 	}
-	cli = c
+	return snapshot
 }
 
-func removeImage(id string) {
+// lastUseRestore sets id's in-memory last-use without writing back to the
+// database. It exists for initDatabase, which populates lastUse from within
+// a bolt transaction where starting another write transaction would block.
+func lastUseRestore(id string, usage time.Time) {
+	lastUseMu.Lock()
+	lastUse[id] = usage
+	metricTrackedImages.Set(float64(len(lastUse)))
+	lastUseMu.Unlock()
+}
+
+func removeImage(id string) ([]types.ImageDeleteResponseItem, error) {
 	log.WithField("id", id).Info("Removing image")
-	_, err := cli.ImageRemove(context.Background(), id, types.ImageRemoveOptions{})
+	deleted, err := rt.ImageRemove(context.Background(), id)
 	if err != nil {
 		log.WithError(err).WithField("id", id).Error("Cannot remove image")
-		return
+		return nil, err
 	}
 	if db != nil {
 		db.Update(func(tx *bolt.Tx) error {
@@ -70,7 +180,8 @@ func removeImage(id string) {
 			return nil
 		})
 	}
-	delete(lastUse, id)
+	lastUseDelete(id)
+	return deleted, nil
 }
 
 func updateImageLastUsage(id string, usage time.Time) {
@@ -96,19 +207,19 @@ func updateImageLastUsage(id string, usage time.Time) {
 		// TODO what to do if db cannot be updated?
 	}
 
-	lastUse[id] = usage
+	lastUseSet(id, usage)
 }
 
 func loadImageDataFromDocker() {
 	now := time.Now()
 	log.Info("Setting last use from containers")
-	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
+	containers, err := rt.ContainerList(context.Background(), true)
 	if err != nil {
 		log.WithError(err).Warn("Cannot get list of containers, image last usage may be less accurate")
 	} else {
 		for _, container := range containers {
 			log.WithField("Container", container.ID).Debug("Reading container")
-			img, _, err := cli.ImageInspectWithRaw(context.Background(), container.Image)
+			img, err := rt.ImageInspectWithRaw(context.Background(), container.Image)
 			if err != nil {
 				log.WithError(err).WithField("Container", container.ID).
 					Warn("Cannot inspect image for container")
@@ -117,7 +228,7 @@ func loadImageDataFromDocker() {
 			var usage time.Time
 			if strings.HasPrefix(container.Status, "Exit") {
 				log.WithField("Container", container.ID).Debug("Container exited, adjusting image last usage")
-				details, err := cli.ContainerInspect(context.Background(), container.ID)
+				details, err := rt.ContainerInspect(context.Background(), container.ID)
 				if err != nil {
 					log.WithField("Container", container.ID).
 						WithError(err).Warn("Cannot inspect container, skipping image update")
@@ -133,21 +244,21 @@ func loadImageDataFromDocker() {
 			} else {
 				usage = now
 			}
-			if old, ok := lastUse[img.ID]; !ok || old.Before(usage) {
+			if old, ok := lastUseGet(img.ID); !ok || old.Before(usage) {
 				updateImageLastUsage(img.ID, usage)
 			}
 		}
 	}
 
-	log.Info("Reading image data from Docker")
-	images, err := cli.ImageList(context.Background(), types.ImageListOptions{})
+	log.Info("Reading image data from runtime")
+	images, err := rt.ImageList(context.Background(), filters.NewArgs())
 	if err != nil {
-		log.WithError(err).Warn("Cannot list images from Docker")
+		log.WithError(err).Warn("Cannot list images from runtime")
 		return
 	}
 	for _, image := range images {
 		log.WithField("ID", image.ID).Debug("Reading image")
-		if old, exists := lastUse[image.ID]; exists {
+		if old, exists := lastUseGet(image.ID); exists {
 			log.WithField("ID", image.ID).WithField("Usage", old).Debug("Not updating image")
 		} else {
 			log.WithField("ID", image.ID).WithField("Usage", now).Debug("Updating image")
@@ -194,7 +305,7 @@ func initDatabase() error {
 				"Image":    string(id),
 				"Last use": decoded,
 			}).Debug("Retrieved image data")
-			lastUse[string(id)] = decoded
+			lastUseRestore(string(id), decoded)
 		}
 		return nil
 	})
@@ -202,7 +313,20 @@ func initDatabase() error {
 }
 
 func prepare() {
-	err := initDatabase()
+	if *runtimeKind == "" || *runtimeKind == "docker" {
+		c, err := client.NewEnvClient()
+		if err != nil {
+			log.Fatal("Failed to setup docker client " + err.Error())
+		}
+		cli = c
+	}
+	r, err := newRuntime()
+	if err != nil {
+		log.Fatal("Failed to setup runtime: " + err.Error())
+	}
+	rt = r
+
+	err = initDatabase()
 	if err != nil {
 		log.WithError(err).Warn("Cannot init database, persistence disabled")
 		if db != nil {
@@ -210,6 +334,7 @@ func prepare() {
 			db = nil
 		}
 	}
+	initResourceBuckets()
 	loadImageDataFromDocker()
 	log.Infof("Loaded %d images from Docker", len(lastUse))
 }
@@ -225,59 +350,51 @@ func main() {
 
 	log.WithField("MaxAge", maxAge).Info("Will purge all images unused")
 
+	images := NewImageService(rt)
+
+	startHTTPServer(images)
+	go watchEvents(context.Background())
+
 	ticker := time.NewTicker(*purgeFrequency)
 
 	for {
 		select {
 		case <-ticker.C:
-			collect()
-		}
-
-	}
-}
-
-func collect() {
-	filters := filters.NewArgs()
-	filters.Add("dangling", "true")
-	dangling, err := cli.ImageList(context.Background(), types.ImageListOptions{Filters: filters})
-	if err != nil {
-		// TODO isn't Fatal a be too much
-		log.WithError(err).Fatal("Cannot get list of dangling images")
-	}
-	for _, image := range dangling {
-		log.WithField("id", image.ID).Info("Remove dangling image")
-		removeImage(image.ID)
-	}
-
-	inUse := map[string]bool{}
-	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{All: true})
-	if err != nil {
-		// TODO isn't Fatal a be too much
-		log.WithError(err).Fatal("Cannot get list of containers")
-	}
-	for _, container := range containers {
-		img, _, err := cli.ImageInspectWithRaw(context.Background(), container.Image)
-		if err != nil {
-			log.WithError(err).WithField("Container", container.ID).
-				Warn("Cannot inspect image for container")
-			continue
+			danglingFilters := filters.NewArgs()
+			danglingFilters.Add("dangling", "true")
+			if _, err := images.Prune(context.Background(), danglingFilters); err != nil {
+				log.WithError(err).Warn("Cannot prune dangling images")
+			}
+			if _, err := images.Prune(context.Background(), filters.NewArgs()); err != nil {
+				log.WithError(err).Warn("Cannot prune unused images")
+			}
+			if cli == nil && (*pruneContainers || *pruneVolumes || *pruneNetworks) {
+				log.Warn("-pruneContainers/-pruneVolumes/-pruneNetworks require -runtime=docker, skipping")
+			} else {
+				if *pruneContainers {
+					if report, err := pruneExitedContainers(context.Background()); err != nil {
+						log.WithError(err).Warn("Cannot prune exited containers")
+					} else if len(report.Removed) > 0 {
+						log.WithFields(log.Fields{"removed": len(report.Removed), "reclaimed": report.SpaceReclaimed}).
+							Info("Pruned exited containers")
+					}
+				}
+				if *pruneVolumes {
+					if report, err := pruneUnusedVolumes(context.Background()); err != nil {
+						log.WithError(err).Warn("Cannot prune unused volumes")
+					} else if len(report.Removed) > 0 {
+						log.WithField("removed", len(report.Removed)).Info("Pruned unused volumes")
+					}
+				}
+				if *pruneNetworks {
+					if report, err := pruneUnusedNetworks(context.Background()); err != nil {
+						log.WithError(err).Warn("Cannot prune unused networks")
+					} else if len(report.Removed) > 0 {
+						log.WithField("removed", len(report.Removed)).Info("Pruned unused networks")
+					}
+				}
+			}
 		}
-		log.WithFields(log.Fields{"image": img.ID, "container": container.ID}).Debug("Image is used by container")
-		inUse[img.ID] = true
-	}
 
-	max := time.Now().Add(time.Duration(-1 * maxAge.Nanoseconds()))
-	log.WithField("Since", max.Truncate(time.Second)).Debug("Purging all unused image")
-	images, err := cli.ImageList(context.Background(), types.ImageListOptions{})
-	if err != nil {
-		log.Fatal(err)
 	}
-	for _, image := range images {
-		id := image.ID
-		if use, ok := lastUse[id]; ok && use.Before(max) && !inUse[id] {
-			log.WithFields(log.Fields{"id": id, "use": use}).Info("Purging unused image")
-			removeImage(image.ID)
-		}
-	}
-
 }
@@ -0,0 +1,71 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"github.com/docker/docker/api/types"
+	"regexp"
+	"testing"
+)
+
+func TestIsKept(t *testing.T) {
+	old := keep
+	defer func() { keep = old }()
+
+	keep = keepFlag{regexp.MustCompile(`^myapp:`), regexp.MustCompile(`:latest$`)}
+
+	cases := []struct {
+		name     string
+		repoTags []string
+		want     bool
+	}{
+		{"matches first pattern", []string{"myapp:v1"}, true},
+		{"matches second pattern", []string{"other:latest"}, true},
+		{"matches no pattern", []string{"other:v1"}, false},
+		{"no repo tags", nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isKept(c.repoTags); got != c.want {
+				t.Errorf("isKept(%v) = %v, want %v", c.repoTags, got, c.want)
+			}
+		})
+	}
+}
+
+func TestKeepMinCountIDs(t *testing.T) {
+	images := []types.ImageSummary{
+		{ID: "old", RepoTags: []string{"myapp:v1"}, Created: 1},
+		{ID: "mid", RepoTags: []string{"myapp:v2"}, Created: 2},
+		{ID: "new", RepoTags: []string{"myapp:v3"}, Created: 3},
+		{ID: "other", RepoTags: []string{"other:v1"}, Created: 1},
+	}
+
+	protected := keepMinCountIDs(images, 2)
+	if !protected["new"] || !protected["mid"] {
+		t.Errorf("expected the 2 most recently created myapp tags to be protected, got %v", protected)
+	}
+	if protected["old"] {
+		t.Errorf("expected the oldest myapp tag not to be protected, got %v", protected)
+	}
+	if !protected["other"] {
+		t.Errorf("expected other:v1, the only tag of its repository, to be protected when n=2 per repo, got %v", protected)
+	}
+
+	if protected := keepMinCountIDs(images, 0); len(protected) != 0 {
+		t.Errorf("keepMinCountIDs with n=0 should protect nothing, got %v", protected)
+	}
+}
@@ -0,0 +1,155 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var listenAddr = flag.String("listen", "", "Address for the HTTP control plane to listen on (e.g. :8080); disabled when empty")
+
+var (
+	metricImagesRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dockergc_images_removed_total",
+		Help: "Total number of images removed by docker-gc.",
+	})
+	metricBytesReclaimed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dockergc_bytes_reclaimed_total",
+		Help: "Total number of bytes reclaimed by removing images.",
+	})
+	metricPruneErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dockergc_prune_errors_total",
+		Help: "Total number of prune calls that failed.",
+	})
+	metricTrackedImages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dockergc_tracked_images",
+		Help: "Number of images currently tracked with a last-use timestamp.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricImagesRemoved, metricBytesReclaimed, metricPruneErrors, metricTrackedImages)
+}
+
+// imageRecord is the JSON representation of a tracked image returned by GET /images.
+type imageRecord struct {
+	ID      string    `json:"id"`
+	LastUse time.Time `json:"lastUse"`
+}
+
+// startHTTPServer starts the HTTP control plane in the background if -listen
+// is set. It exposes endpoints to inspect and drive the ImageService without
+// waiting for the next ticker run.
+func startHTTPServer(images *ImageService) {
+	if *listenAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images", handleListImages)
+	mux.HandleFunc("/images/", handleTouchImage)
+	mux.HandleFunc("/prune", handlePrune(images))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.WithField("addr", *listenAddr).Info("Starting HTTP control plane")
+	go func() {
+		if err := http.ListenAndServe(*listenAddr, mux); err != nil {
+			log.WithError(err).Error("HTTP control plane stopped, GC will continue without it")
+		}
+	}()
+}
+
+func handleListImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot := lastUseSnapshot()
+	records := make([]imageRecord, 0, len(snapshot))
+	for id, usage := range snapshot {
+		records = append(records, imageRecord{ID: id, LastUse: usage})
+	}
+	writeJSON(w, records)
+}
+
+// handleTouchImage implements POST /images/{id}/touch, bumping an image's
+// last-use so external orchestrators can report out-of-band consumption.
+func handleTouchImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/touch") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/touch")
+	if id == "" {
+		http.Error(w, "missing image id", http.StatusBadRequest)
+		return
+	}
+	updateImageLastUsage(id, time.Now())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handlePrune(images *ImageService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := images.Prune(r.Context(), pruneFiltersFromQuery(r.URL.Query()))
+		if errors.Is(err, ErrPruneInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, report)
+	}
+}
+
+func pruneFiltersFromQuery(query url.Values) filters.Args {
+	filterArgs := filters.NewArgs()
+	for _, kv := range query["label"] {
+		filterArgs.Add("label", kv)
+	}
+	for _, kv := range query["label!"] {
+		filterArgs.Add("label!", kv)
+	}
+	if dangling := query.Get("dangling"); dangling != "" {
+		filterArgs.Add("dangling", dangling)
+	}
+	if until := query.Get("until"); until != "" {
+		filterArgs.Add("until", until)
+	}
+	return filterArgs
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Cannot encode JSON response")
+	}
+}
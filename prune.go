@@ -0,0 +1,214 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPruneInProgress is returned by ImageService.Prune when another prune
+// call is already running.
+var ErrPruneInProgress = errors.New("a prune is already running")
+
+// PruneReport summarizes the outcome of an ImageService.Prune call, mirroring
+// the shape of the Docker daemon's own image prune report.
+type PruneReport struct {
+	ImagesDeleted  []types.ImageDeleteResponseItem
+	SpaceReclaimed uint64
+}
+
+// ImageService runs image garbage collection against a Runtime, so the same
+// prune policy applies regardless of the backing container engine.
+type ImageService struct {
+	runtime Runtime
+	pruning int32
+}
+
+// NewImageService creates an ImageService backed by the given Runtime.
+func NewImageService(runtime Runtime) *ImageService {
+	return &ImageService{runtime: runtime}
+}
+
+// Prune removes images that are not in use, not protected by -keep or
+// -keepMinCount, and match filterArgs. It accepts the same filter keys as
+// `docker image prune`: dangling, label, label!, and until. Concurrent calls
+// are rejected with an error so that two prune runs never race each other.
+func (s *ImageService) Prune(ctx context.Context, filterArgs filters.Args) (report *PruneReport, err error) {
+	if !atomic.CompareAndSwapInt32(&s.pruning, 0, 1) {
+		return nil, ErrPruneInProgress
+	}
+	defer atomic.StoreInt32(&s.pruning, 0)
+	defer func() {
+		if err != nil {
+			metricPruneErrors.Inc()
+		}
+	}()
+
+	since := time.Now().Add(time.Duration(-1 * maxAge.Nanoseconds()))
+	if until := filterArgs.Get("until"); len(until) > 0 {
+		cutoff, err := parseUntil(until[0])
+		if err != nil {
+			return nil, err
+		}
+		if cutoff.After(since) {
+			since = cutoff
+		}
+	}
+
+	onlyDangling := filterArgs.ExactMatch("dangling", "true")
+
+	// Only the dangling filter is forwarded to the runtime: its definition of
+	// "dangling" matches ours exactly, whereas label/until need our own
+	// lastUse-aware evaluation below rather than the daemon's Created-time
+	// semantics.
+	listFilters := filters.NewArgs()
+	if onlyDangling {
+		listFilters.Add("dangling", "true")
+	}
+	images, err := s.runtime.ImageList(ctx, listFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse, err := s.imagesInUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := keepMinCountIDs(images, *keepMinCount)
+	report = &PruneReport{}
+
+	for _, image := range images {
+		id := image.ID
+		if isKept(image.RepoTags) || kept[id] {
+			continue
+		}
+		if inUse[id] {
+			continue
+		}
+		if !onlyDangling {
+			use, tracked := lastUseGet(id)
+			if !tracked || use.After(since) {
+				continue
+			}
+		}
+		if !s.matchesLabelFilters(ctx, id, filterArgs) {
+			continue
+		}
+
+		log.WithField("id", id).Info("Pruning image")
+		deleted, err := removeImage(id)
+		if err != nil {
+			continue
+		}
+		report.ImagesDeleted = append(report.ImagesDeleted, deleted...)
+		report.SpaceReclaimed += uint64(image.Size)
+	}
+
+	log.WithFields(log.Fields{
+		"deleted":   len(report.ImagesDeleted),
+		"reclaimed": report.SpaceReclaimed,
+	}).Info("Prune complete")
+
+	metricImagesRemoved.Add(float64(len(report.ImagesDeleted)))
+	metricBytesReclaimed.Add(float64(report.SpaceReclaimed))
+
+	return report, nil
+}
+
+// imagesInUse returns the set of image IDs currently referenced by a container.
+func (s *ImageService) imagesInUse(ctx context.Context) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	containers, err := s.runtime.ContainerList(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		img, err := s.runtime.ImageInspectWithRaw(ctx, container.Image)
+		if err != nil {
+			log.WithError(err).WithField("Container", container.ID).
+				Warn("Cannot inspect image for container")
+			continue
+		}
+		inUse[img.ID] = true
+	}
+	return inUse, nil
+}
+
+// matchesLabelFilters evaluates the label and label! filters against the
+// image's labels, inspecting the image only when such filters are present.
+func (s *ImageService) matchesLabelFilters(ctx context.Context, imageID string, filterArgs filters.Args) bool {
+	require := filterArgs.Get("label")
+	exclude := filterArgs.Get("label!")
+	if len(require) == 0 && len(exclude) == 0 {
+		return true
+	}
+	inspect, err := s.runtime.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		log.WithError(err).WithField("id", imageID).Warn("Cannot inspect image for label filter")
+		return false
+	}
+	var labels map[string]string
+	if inspect.Config != nil {
+		labels = inspect.Config.Labels
+	}
+	for _, kv := range require {
+		if !labelMatches(labels, kv) {
+			return false
+		}
+	}
+	for _, kv := range exclude {
+		if labelMatches(labels, kv) {
+			return false
+		}
+	}
+	return true
+}
+
+func labelMatches(labels map[string]string, kv string) bool {
+	key, value, hasValue := kv, "", false
+	if i := strings.Index(kv, "="); i >= 0 {
+		key, value, hasValue = kv[:i], kv[i+1:], true
+	}
+	actual, ok := labels[key]
+	if !ok {
+		return false
+	}
+	if !hasValue {
+		return true
+	}
+	return actual == value
+}
+
+// parseUntil parses an until filter value as either a duration (e.g. "24h",
+// relative to now) or an RFC3339 timestamp.
+func parseUntil(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-1 * d), nil
+	}
+	if ts, err := time.Parse(time.RFC3339, value); err == nil {
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse until filter %q as a duration or RFC3339 timestamp", value)
+}
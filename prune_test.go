@@ -0,0 +1,79 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLabelMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "infra"}
+
+	cases := []struct {
+		name string
+		kv   string
+		want bool
+	}{
+		{"key and value match", "env=prod", true},
+		{"key matches, value differs", "env=staging", false},
+		{"bare key present", "team", true},
+		{"bare key absent", "missing", false},
+		{"key=value absent", "missing=value", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := labelMatches(labels, c.kv); got != c.want {
+				t.Errorf("labelMatches(%v, %q) = %v, want %v", labels, c.kv, got, c.want)
+			}
+		})
+	}
+
+	if labelMatches(nil, "env") {
+		t.Errorf("labelMatches(nil, %q) = true, want false", "env")
+	}
+}
+
+func TestParseUntil(t *testing.T) {
+	t.Run("duration", func(t *testing.T) {
+		before := time.Now().Add(-24 * time.Hour)
+		got, err := parseUntil("24h")
+		if err != nil {
+			t.Fatalf("parseUntil(24h) returned error: %v", err)
+		}
+		after := time.Now().Add(-24 * time.Hour)
+		if got.Before(before) || got.After(after.Add(time.Second)) {
+			t.Errorf("parseUntil(24h) = %v, want roughly 24h ago", got)
+		}
+	})
+
+	t.Run("RFC3339 timestamp", func(t *testing.T) {
+		want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		got, err := parseUntil(want.Format(time.RFC3339))
+		if err != nil {
+			t.Fatalf("parseUntil(RFC3339) returned error: %v", err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseUntil(%s) = %v, want %v", want.Format(time.RFC3339), got, want)
+		}
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		if _, err := parseUntil("not-a-time"); err == nil {
+			t.Errorf("parseUntil(not-a-time) expected an error, got nil")
+		}
+	})
+}
@@ -0,0 +1,280 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/boltdb/bolt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	BUCKET_VOLUME  = "volumes"
+	BUCKET_NETWORK = "networks"
+)
+
+var (
+	pruneContainers = flag.Bool("pruneContainers", false, "Enable pruning of exited containers")
+	containerMaxAge = flag.Duration("containerMaxAge", 24*time.Hour, "Max duration since a container exited before it is removed")
+	pruneVolumes    = flag.Bool("pruneVolumes", false, "Enable pruning of unused volumes")
+	volumeMaxAge    = flag.Duration("volumeMaxAge", 24*time.Hour, "Max duration a volume may stay unused before it is removed")
+	pruneNetworks   = flag.Bool("pruneNetworks", false, "Enable pruning of unused user-defined networks")
+	networkMaxAge   = flag.Duration("networkMaxAge", 24*time.Hour, "Max duration a network may stay unused before it is removed")
+
+	volumeLastUse  = map[string]time.Time{}
+	networkLastUse = map[string]time.Time{}
+)
+
+// ResourcePruneReport summarizes a containers/volumes/networks prune pass.
+type ResourcePruneReport struct {
+	Removed        []string
+	SpaceReclaimed uint64
+}
+
+// initResourceBuckets creates the volumes/networks buckets alongside the
+// images one, and restores their last-use maps tracked across restarts.
+// Containers need no bucket of their own: unlike volumes and networks, a
+// container's last use is its own FinishedAt, which Docker already persists
+// for us and pruneExitedContainers reads live on every tick.
+func initResourceBuckets() {
+	if db == nil {
+		return
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{BUCKET_VOLUME, BUCKET_NETWORK} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				log.WithError(err).WithField("Bucket", bucket).Error("Cannot create bucket")
+				return err
+			}
+		}
+		return nil
+	})
+	loadLastUse(BUCKET_VOLUME, volumeLastUse)
+	loadLastUse(BUCKET_NETWORK, networkLastUse)
+}
+
+func loadLastUse(bucket string, into map[string]time.Time) {
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for id, usage := c.First(); id != nil; id, usage = c.Next() {
+			var decoded time.Time
+			if err := decoded.GobDecode(usage); err != nil {
+				log.WithError(err).WithField("id", string(id)).Warn("Cannot decode last usage")
+				continue
+			}
+			into[string(id)] = decoded
+		}
+		return nil
+	})
+}
+
+func recordLastUse(bucket, id string, usage time.Time, into map[string]time.Time) {
+	if db != nil {
+		db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			encoded, err := usage.GobEncode()
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(id), encoded)
+		})
+	}
+	into[id] = usage
+}
+
+func forgetLastUse(bucket, id string, from map[string]time.Time) {
+	if db != nil {
+		db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			return b.Delete([]byte(id))
+		})
+	}
+	delete(from, id)
+}
+
+// pruneExitedContainers removes exited containers whose FinishedAt is older
+// than containerMaxAge.
+func pruneExitedContainers(ctx context.Context) (*ResourcePruneReport, error) {
+	report := &ResourcePruneReport{}
+
+	exitedFilters := filters.NewArgs()
+	exitedFilters.Add("status", "exited")
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Size: true, Filters: exitedFilters})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-1 * *containerMaxAge)
+	for _, c := range containers {
+		details, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			log.WithError(err).WithField("id", c.ID).Warn("Cannot inspect exited container")
+			continue
+		}
+		finishedAt, err := time.Parse(time.RFC3339, details.State.FinishedAt)
+		if err != nil {
+			log.WithError(err).WithField("id", c.ID).Warn("Cannot parse FinishedAt, skipping")
+			continue
+		}
+		if finishedAt.After(cutoff) {
+			continue
+		}
+		log.WithField("id", c.ID).Info("Removing exited container")
+		if err := cli.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{}); err != nil {
+			log.WithError(err).WithField("id", c.ID).Error("Cannot remove container")
+			continue
+		}
+		report.Removed = append(report.Removed, c.ID)
+		report.SpaceReclaimed += uint64(c.SizeRw)
+	}
+	return report, nil
+}
+
+// pruneUnusedVolumes removes volumes that have had no container attached to
+// them for longer than volumeMaxAge. Volumes have no notion of "last used"
+// in the Docker API, so the first tick that observes a volume as unused
+// seeds its last-use time in BUCKET_VOLUME.
+func pruneUnusedVolumes(ctx context.Context) (*ResourcePruneReport, error) {
+	report := &ResourcePruneReport{}
+
+	volumeList, err := cli.VolumeList(ctx, filters.NewArgs())
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := volumesInUse(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-1 * *volumeMaxAge)
+	seen := map[string]bool{}
+	for _, v := range volumeList.Volumes {
+		seen[v.Name] = true
+		if inUse[v.Name] {
+			recordLastUse(BUCKET_VOLUME, v.Name, time.Now(), volumeLastUse)
+			continue
+		}
+		unusedSince, tracked := volumeLastUse[v.Name]
+		if !tracked {
+			recordLastUse(BUCKET_VOLUME, v.Name, time.Now(), volumeLastUse)
+			continue
+		}
+		if unusedSince.After(cutoff) {
+			continue
+		}
+		log.WithField("name", v.Name).Info("Removing unused volume")
+		if err := cli.VolumeRemove(ctx, v.Name, false); err != nil {
+			log.WithError(err).WithField("name", v.Name).Error("Cannot remove volume")
+			continue
+		}
+		forgetLastUse(BUCKET_VOLUME, v.Name, volumeLastUse)
+		report.Removed = append(report.Removed, v.Name)
+	}
+	for name := range volumeLastUse {
+		if !seen[name] {
+			forgetLastUse(BUCKET_VOLUME, name, volumeLastUse)
+		}
+	}
+	return report, nil
+}
+
+func volumesInUse(ctx context.Context) (map[string]bool, error) {
+	inUse := map[string]bool{}
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		details, err := cli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			log.WithError(err).WithField("Container", c.ID).Warn("Cannot inspect container for volume usage")
+			continue
+		}
+		for _, mount := range details.Mounts {
+			if mount.Name != "" {
+				inUse[mount.Name] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// pruneUnusedNetworks removes user-defined networks that have had no
+// containers attached for longer than networkMaxAge, leaving the builtin
+// bridge/host/none networks untouched. Mirrors pruneUnusedVolumes: the first
+// tick that observes a network as unused only seeds its last-use time in
+// BUCKET_NETWORK, so a network created just before its containers attach
+// (e.g. by `docker network create` or a compose `up`) is given a grace
+// period rather than removed immediately.
+func pruneUnusedNetworks(ctx context.Context) (*ResourcePruneReport, error) {
+	report := &ResourcePruneReport{}
+
+	networkList, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-1 * *networkMaxAge)
+	seen := map[string]bool{}
+	for _, n := range networkList {
+		if isBuiltinNetwork(n.Name) {
+			continue
+		}
+		seen[n.ID] = true
+		if len(n.Containers) > 0 {
+			recordLastUse(BUCKET_NETWORK, n.ID, time.Now(), networkLastUse)
+			continue
+		}
+		unusedSince, tracked := networkLastUse[n.ID]
+		if !tracked {
+			recordLastUse(BUCKET_NETWORK, n.ID, time.Now(), networkLastUse)
+			continue
+		}
+		if unusedSince.After(cutoff) {
+			continue
+		}
+		log.WithField("name", n.Name).Info("Removing unused network")
+		if err := cli.NetworkRemove(ctx, n.ID); err != nil {
+			log.WithError(err).WithField("name", n.Name).Error("Cannot remove network")
+			continue
+		}
+		forgetLastUse(BUCKET_NETWORK, n.ID, networkLastUse)
+		report.Removed = append(report.Removed, n.Name)
+	}
+	for id := range networkLastUse {
+		if !seen[id] {
+			forgetLastUse(BUCKET_NETWORK, id, networkLastUse)
+		}
+	}
+	return report, nil
+}
+
+func isBuiltinNetwork(name string) bool {
+	switch name {
+	case "bridge", "host", "none":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,56 @@
+/**
+ * Copyright 2015 Nicolas De Loof
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+var (
+	runtimeKind    = flag.String("runtime", "docker", "Container runtime backend to use: docker or containerd")
+	runtimeAddress = flag.String("address", "", "Socket address for the selected runtime (defaults to the runtime's standard socket)")
+)
+
+// Runtime abstracts the container-engine operations docker-gc needs, so the
+// same age/label/keep policies in Prune can run against either a
+// Docker Engine or a containerd socket, e.g. on a Kubernetes node that no
+// longer runs dockerd.
+type Runtime interface {
+	ImageList(ctx context.Context, filterArgs filters.Args) ([]types.ImageSummary, error)
+	ImageInspectWithRaw(ctx context.Context, id string) (types.ImageInspect, error)
+	ImageRemove(ctx context.Context, id string) ([]types.ImageDeleteResponseItem, error)
+	ContainerList(ctx context.Context, all bool) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error)
+	Events(ctx context.Context) (<-chan events.Message, <-chan error)
+}
+
+// newRuntime builds the Runtime selected by -runtime. It must be called
+// after flag.Parse() and, for the docker runtime, after cli is set up.
+func newRuntime() (Runtime, error) {
+	switch *runtimeKind {
+	case "", "docker":
+		return newDockerRuntime()
+	case "containerd":
+		return newContainerdRuntime(*runtimeAddress)
+	default:
+		return nil, fmt.Errorf("unknown runtime %q, must be docker or containerd", *runtimeKind)
+	}
+}